@@ -0,0 +1,135 @@
+package main
+
+/*
+#include <stdlib.h>
+#include "pv_buffer.h"
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire encodings selectable via the encoding parameter on query paths that
+// return a PVBuffer.
+const (
+	EncodingJSON        = 0
+	EncodingMessagePack = 1
+	EncodingCustom      = 2
+)
+
+var (
+	bufferRegistry  sync.Map // map[uint64][]byte
+	bufferNextToken uint64
+)
+
+// makeBuffer pins data in bufferRegistry, keyed by a fresh token, so the Go
+// GC won't reclaim it while C holds a pointer into it. The caller is
+// responsible for releasing it with pv_buffer_free once done.
+func makeBuffer(data []byte) C.PVBuffer {
+	token := atomic.AddUint64(&bufferNextToken, 1)
+	bufferRegistry.Store(token, data)
+	var ptr unsafe.Pointer
+	if len(data) > 0 {
+		ptr = unsafe.Pointer(&data[0])
+	}
+	return C.PVBuffer{
+		data:  ptr,
+		len:   C.size_t(len(data)),
+		token: C.uint64_t(token),
+	}
+}
+
+// emptyBuffer returns a zeroed PVBuffer for error paths, carrying no token
+// and therefore nothing for the caller to free.
+func emptyBuffer() C.PVBuffer {
+	return C.PVBuffer{}
+}
+
+//export pv_buffer_free
+func pv_buffer_free(token uint64) {
+	bufferRegistry.Delete(token)
+}
+
+// encodeObjects serializes a slice of raw object JSON strings using the
+// requested wire encoding. encoding EncodingCustom is only meaningful for
+// SpatialObject payloads (query_spatial_index_by_area); callers that can't
+// guarantee that shape should fall back to EncodingJSON.
+func encodeObjects(objs []string, encoding int) ([]byte, error) {
+	switch encoding {
+	case EncodingMessagePack:
+		return msgpack.Marshal(rawMessages(objs))
+	case EncodingCustom:
+		return encodeCustomFraming(objs)
+	default:
+		return json.Marshal(rawMessages(objs))
+	}
+}
+
+// encodeValue serializes an arbitrary result value (e.g. []NearestResult)
+// as JSON or MessagePack. Custom framing has no generic representation, so
+// it falls back to JSON.
+func encodeValue(v interface{}, encoding int) ([]byte, error) {
+	switch encoding {
+	case EncodingMessagePack:
+		return msgpack.Marshal(v)
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func rawMessages(objs []string) []json.RawMessage {
+	raw := make([]json.RawMessage, len(objs))
+	for i, o := range objs {
+		raw[i] = json.RawMessage(o)
+	}
+	return raw
+}
+
+// encodeCustomFraming packs SpatialObjects using the compact hot-path
+// framing: [count:u32][{uuid:16, x:f64, y:f64, z:f64, dataLen:u32, data:bytes}...].
+func encodeCustomFraming(objs []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(objs))); err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		var obj SpatialObject
+		if err := json.Unmarshal([]byte(o), &obj); err != nil {
+			return nil, fmt.Errorf("custom framing requires SpatialObject payloads: %w", err)
+		}
+		uuidBytes, err := packUUID(obj.UUID)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(uuidBytes[:])
+		binary.Write(&buf, binary.LittleEndian, obj.X)
+		binary.Write(&buf, binary.LittleEndian, obj.Y)
+		binary.Write(&buf, binary.LittleEndian, obj.Z)
+		data := []byte(obj.Data)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// packUUID strips the dashes from a canonical UUID string and decodes the
+// remaining 32 hex characters into the raw 16 bytes they encode.
+func packUUID(uuid string) ([16]byte, error) {
+	var out [16]byte
+	decoded, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(decoded) != 16 {
+		return out, fmt.Errorf("invalid uuid for custom framing: %s", uuid)
+	}
+	copy(out[:], decoded)
+	return out, nil
+}
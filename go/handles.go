@@ -0,0 +1,98 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Error codes returned by exports that previously returned nothing. Every
+// failure is negative: pvErrInvalidHandle and pvErrClosedHandle report
+// handle-lifecycle failures, while pvErrOperation reports that the underlying
+// BuntDB call failed (the BuntDB error itself is only logged server-side).
+const (
+	pvOK               = 0
+	pvErrInvalidHandle = -1
+	pvErrClosedHandle  = -2
+	pvErrOperation     = -3
+)
+
+// dbEntry is what a handle actually resolves to: the real *buntdb.DB plus
+// enough bookkeeping to make double-close and use-after-close errors instead
+// of memory corruption.
+type dbEntry struct {
+	mu      sync.RWMutex
+	db      *buntdb.DB
+	indices map[string]bool
+	closed  bool
+}
+
+var (
+	dbRegistry   sync.Map // map[uint64]*dbEntry
+	dbNextHandle uint64
+)
+
+// registerDB allocates a fresh handle for an already-opened database and
+// hands ownership of it to the registry.
+func registerDB(db *buntdb.DB) uint64 {
+	handle := atomic.AddUint64(&dbNextHandle, 1)
+	dbRegistry.Store(handle, &dbEntry{db: db, indices: make(map[string]bool)})
+	return handle
+}
+
+// lookupDB resolves a handle to its entry, rejecting unknown or closed
+// handles instead of letting callers dereference a freed/moved pointer.
+func lookupDB(handle uint64) (*dbEntry, error) {
+	v, ok := dbRegistry.Load(handle)
+	if !ok {
+		return nil, fmt.Errorf("invalid db handle: %d", handle)
+	}
+	entry := v.(*dbEntry)
+	entry.mu.RLock()
+	closed := entry.closed
+	entry.mu.RUnlock()
+	if closed {
+		return nil, fmt.Errorf("db handle %d is closed", handle)
+	}
+	return entry, nil
+}
+
+//export close_db
+func close_db(handle uint64) int {
+	v, ok := dbRegistry.Load(handle)
+	if !ok {
+		return pvErrInvalidHandle
+	}
+	entry := v.(*dbEntry)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.closed {
+		return pvErrClosedHandle
+	}
+	entry.closed = true
+	dbRegistry.Delete(handle)
+	removeTagRegistry(handle)
+	if err := entry.db.Close(); err != nil {
+		fmt.Printf("Error closing db handle %d: %v\n", handle, err)
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+//export list_open_handles
+func list_open_handles() *C.char {
+	var handles []uint64
+	dbRegistry.Range(func(key, _ interface{}) bool {
+		handles = append(handles, key.(uint64))
+		return true
+	})
+	jsonResult, _ := json.Marshal(handles)
+	return C.CString(string(jsonResult))
+}
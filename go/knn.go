@@ -0,0 +1,93 @@
+package main
+
+/*
+#include <stdlib.h>
+#include "pv_buffer.h"
+*/
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/tidwall/buntdb"
+)
+
+// NearestResult pairs a raw object payload with its distance from the query
+// point, in the order returned by query_nearest / query_within_radius.
+type NearestResult struct {
+	Object   json.RawMessage `json:"object"`
+	Distance float64         `json:"distance"`
+}
+
+//export query_nearest
+func query_nearest(handle uint64, indexName *C.char, x, y, z float64, k int, encoding int) C.PVBuffer {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in query_nearest: %v\n", err)
+		return emptyBuffer()
+	}
+	if k <= 0 {
+		fmt.Printf("Error in query_nearest: k must be positive, got %d\n", k)
+		return emptyBuffer()
+	}
+
+	results := make([]NearestResult, 0, k)
+	point := fmt.Sprintf("[%f %f %f]", x, y, z)
+
+	err = entry.db.View(func(tx *buntdb.Tx) error {
+		return tx.Nearby(C.GoString(indexName), point, func(key, val string, dist float64) bool {
+			if len(results) >= k {
+				return false
+			}
+			// dist is rtree's squared Euclidean distance; take its square
+			// root so the "distance" field callers see is real-world units,
+			// not squared ones.
+			results = append(results, NearestResult{Object: json.RawMessage(val), Distance: math.Sqrt(dist)})
+			return len(results) < k
+		})
+	})
+	if err != nil {
+		fmt.Printf("Error running nearest-neighbor query: %v\n", err)
+		return emptyBuffer()
+	}
+
+	encoded, err := encodeValue(results, encoding)
+	if err != nil {
+		fmt.Printf("Error encoding nearest-neighbor result: %v\n", err)
+		return emptyBuffer()
+	}
+	return makeBuffer(encoded)
+}
+
+//export query_within_radius
+func query_within_radius(handle uint64, indexName *C.char, x, y, z, radius float64) *C.char {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in query_within_radius: %v\n", err)
+		return C.CString("[]")
+	}
+
+	var results []NearestResult
+	point := fmt.Sprintf("[%f %f %f]", x, y, z)
+	radiusSq := radius * radius
+
+	err = entry.db.View(func(tx *buntdb.Tx) error {
+		return tx.Nearby(C.GoString(indexName), point, func(key, val string, dist float64) bool {
+			// Compare against the squared radius while dist is still
+			// squared, then report the real (square-rooted) distance.
+			if dist > radiusSq {
+				return false
+			}
+			results = append(results, NearestResult{Object: json.RawMessage(val), Distance: math.Sqrt(dist)})
+			return true
+		})
+	})
+	if err != nil {
+		fmt.Printf("Error running radius query: %v\n", err)
+		return C.CString("[]")
+	}
+
+	jsonResult, _ := json.Marshal(results)
+	return C.CString(string(jsonResult))
+}
@@ -0,0 +1,47 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"encoding/json"
+	"testing"
+	"unsafe"
+)
+
+func TestQueryNearestFindsObjectAtQueryPoint(t *testing.T) {
+	handle := create_in_memory_db()
+	defer close_db(handle)
+
+	indexName := C.CString("position")
+	defer C.free(unsafe.Pointer(indexName))
+	if rc := create_spatial_index(handle, indexName); rc != pvOK {
+		t.Fatalf("create_spatial_index failed: %d", rc)
+	}
+
+	obj := C.CString(`{"uuid":"abc","x":1,"y":2,"z":3,"data":"enemy"}`)
+	defer C.free(unsafe.Pointer(obj))
+	if rc := add_object_to_spatial_index(handle, obj); rc != pvOK {
+		t.Fatalf("add_object_to_spatial_index failed: %d", rc)
+	}
+
+	buf := query_nearest(handle, indexName, 1, 2, 3, 5, EncodingJSON)
+	if buf.token != 0 {
+		defer pv_buffer_free(uint64(buf.token))
+	}
+	if buf.len == 0 {
+		t.Fatal("expected a non-empty result for a point exactly at the query location")
+	}
+
+	var results []NearestResult
+	if err := json.Unmarshal(C.GoBytes(buf.data, C.int(buf.len)), &results); err != nil {
+		t.Fatalf("invalid json in result buffer: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].Distance != 0 {
+		t.Fatalf("expected zero distance for an exact match, got %f", results[0].Distance)
+	}
+}
@@ -2,62 +2,74 @@ package main
 
 /*
 #include <stdlib.h>
+#include "pv_buffer.h"
 */
-
 import "C"
 import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"unsafe"
 
 	"github.com/tidwall/buntdb"
 )
 
 type SpatialObject struct {
-	UUID string  `json:"uuid"`
-	X    float64 `json:"x"`
-	Y    float64 `json:"y"`
-	Z    float64 `json:"z"`
-	Data string  `json:"data"`
+	UUID string   `json:"uuid"`
+	X    float64  `json:"x"`
+	Y    float64  `json:"y"`
+	Z    float64  `json:"z"`
+	Data string   `json:"data"`
+	Tags []string `json:"tags,omitempty"`
 }
 
 //export create_in_memory_db
-func create_in_memory_db() uintptr {
+func create_in_memory_db() uint64 {
 	db, err := buntdb.Open(":memory:")
 	if err != nil {
 		log.Fatal(err)
 	}
-	return uintptr(unsafe.Pointer(db))
-	// return uintptr(uintptr(unsafe.Pointer(db)))
+	return registerDB(db)
 }
 
 //export close_in_memory_db
-func close_in_memory_db(db uintptr) {
-	// Close the database when done.
-	(*buntdb.DB)(unsafe.Pointer(db)).Close()
+func close_in_memory_db(handle uint64) int {
+	return close_db(handle)
 }
 
 //export free_in_memory_pointer_db
-func free_in_memory_pointer_db(db uintptr) {
-	(*buntdb.DB)(unsafe.Pointer(db)).Close()
+func free_in_memory_pointer_db(handle uint64) int {
+	return close_db(handle)
 }
 
 //export set_object
-func set_object(db uintptr, key *C.char, value *C.char) {
-	// Read-write transactions
-	(*buntdb.DB)(unsafe.Pointer(db)).Update(func(tx *buntdb.Tx) error {
+func set_object(handle uint64, key *C.char, value *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in set_object: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
 		_, _, err := tx.Set(C.GoString(key), C.GoString(value), nil)
 		return err
 	})
+	if err != nil {
+		fmt.Printf("Error setting object: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
 }
 
 //export get_object
-func get_object(db uintptr, key *C.char) *C.char {
+func get_object(handle uint64, key *C.char) *C.char {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in get_object: %v\n", err)
+		return C.CString("")
+	}
 	// Read-only transactions
 	// Getting non-existent values will cause an ErrNotFound error.
 	var result string
-	(*buntdb.DB)(unsafe.Pointer(db)).View(func(tx *buntdb.Tx) error {
+	entry.db.View(func(tx *buntdb.Tx) error {
 		val, err := tx.Get(C.GoString(key))
 		if err != nil {
 			return err
@@ -69,91 +81,177 @@ func get_object(db uintptr, key *C.char) *C.char {
 }
 
 //export delete_object
-func delete_object(db uintptr, key *C.char) {
-	// Read-write transactions
-	(*buntdb.DB)(unsafe.Pointer(db)).Update(func(tx *buntdb.Tx) error {
+func delete_object(handle uint64, key *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in delete_object: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
 		_, err := tx.Delete(C.GoString(key))
 		return err
 	})
+	if err != nil {
+		fmt.Printf("Error deleting object: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+// KVPair is a single key/value entry as returned by get_all_objects.
+type KVPair struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
 }
 
 //export get_all_objects
-func get_all_objects(db uintptr) *C.char {
-	var result string
-	(*buntdb.DB)(unsafe.Pointer(db)).View(func(tx *buntdb.Tx) error {
+func get_all_objects(handle uint64, encoding int) C.PVBuffer {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in get_all_objects: %v\n", err)
+		return emptyBuffer()
+	}
+	var pairs []KVPair
+	entry.db.View(func(tx *buntdb.Tx) error {
 		tx.Ascend("", func(key, val string) bool {
-			result += key + ":" + val + ","
+			pairs = append(pairs, KVPair{Key: key, Val: val})
 			return true
 		})
 		return nil
 	})
-	return C.CString(result)
+	encoded, err := encodeValue(pairs, encoding)
+	if err != nil {
+		fmt.Printf("Error encoding get_all_objects result: %v\n", err)
+		return emptyBuffer()
+	}
+	return makeBuffer(encoded)
 }
 
 //export set_custom_index_objects
-func set_custom_index_objects(db uintptr, indexName *C.char, indexKey *C.char) {
-	(*buntdb.DB)(unsafe.Pointer(db)).CreateIndex(C.GoString(indexName), C.GoString(indexKey), buntdb.IndexString)
+func set_custom_index_objects(handle uint64, indexName *C.char, indexKey *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in set_custom_index_objects: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	if err := entry.db.CreateIndex(C.GoString(indexName), C.GoString(indexKey), buntdb.IndexString); err != nil {
+		fmt.Printf("Error creating custom index: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
 }
 
 //export add_object_to_custom_index
-func add_object_to_custom_index(db uintptr, key *C.char, value *C.char) {
-	(*buntdb.DB)(unsafe.Pointer(db)).Update(func(tx *buntdb.Tx) error {
+func add_object_to_custom_index(handle uint64, key *C.char, value *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in add_object_to_custom_index: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
 		_, _, err := tx.Set(C.GoString(key), C.GoString(value), nil)
 		return err
 	})
+	if err != nil {
+		fmt.Printf("Error adding object to custom index: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
 }
 
 //export iterate_over_custom_index
-func iterate_over_custom_index(db uintptr, indexName *C.char) *C.char {
-	var result string
-	(*buntdb.DB)(unsafe.Pointer(db)).View(func(tx *buntdb.Tx) error {
+func iterate_over_custom_index(handle uint64, indexName *C.char, encoding int) C.PVBuffer {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in iterate_over_custom_index: %v\n", err)
+		return emptyBuffer()
+	}
+	var pairs []KVPair
+	entry.db.View(func(tx *buntdb.Tx) error {
 		tx.Ascend(C.GoString(indexName), func(key, val string) bool {
-			result += key + ":" + val + ","
+			pairs = append(pairs, KVPair{Key: key, Val: val})
 			return true
 		})
 		return nil
 	})
-	return C.CString(result)
+	encoded, err := encodeValue(pairs, encoding)
+	if err != nil {
+		fmt.Printf("Error encoding iterate_over_custom_index result: %v\n", err)
+		return emptyBuffer()
+	}
+	return makeBuffer(encoded)
 }
 
 //export create_spatial_index
-func create_spatial_index(db uintptr, indexName *C.char) {
-	err := (*buntdb.DB)(unsafe.Pointer(db)).CreateSpatialIndex(C.GoString(indexName), "*:*:*:*", index3D)
+func create_spatial_index(handle uint64, indexName *C.char) int {
+	entry, err := lookupDB(handle)
 	if err != nil {
+		fmt.Printf("Error in create_spatial_index: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	name := C.GoString(indexName)
+	if err := entry.db.CreateSpatialIndex(name, "*:*:*:*", index3D); err != nil {
 		fmt.Printf("Error creating spatial index: %v\n", err)
-	} else {
-		fmt.Printf("Spatial index created successfully: %s\n", C.GoString(indexName))
+		return pvErrOperation
 	}
+	entry.mu.Lock()
+	entry.indices[name] = true
+	entry.mu.Unlock()
+	fmt.Printf("Spatial index created successfully: %s\n", name)
+	return pvOK
 }
 
 //export add_object_to_spatial_index
-func add_object_to_spatial_index(db uintptr, jsonData *C.char) {
-	(*buntdb.DB)(unsafe.Pointer(db)).Update(func(tx *buntdb.Tx) error {
-		var obj SpatialObject
-		jsonString := C.GoString(jsonData)
-		fmt.Printf("Adding object: %s\n", jsonString)
-		if err := json.Unmarshal([]byte(jsonString), &obj); err != nil {
-			fmt.Printf("Error unmarshaling JSON: %v\n", err)
-			return err
-		}
-		// Create spatial key in the format that BuntDB expects
-		spatialKey := fmt.Sprintf("%s:%f:%f:%f", obj.UUID, obj.X, obj.Y, obj.Z)
-		_, _, err := tx.Set(spatialKey, jsonString, nil)
-		if err != nil {
-			fmt.Printf("Error setting object: %v\n", err)
-		} else {
-			fmt.Printf("Successfully added object with UUID: %s\n", obj.UUID)
-		}
-		return err
+func add_object_to_spatial_index(handle uint64, jsonData *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in add_object_to_spatial_index: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
+		return setSpatialObject(handle, tx, C.GoString(jsonData), nil)
 	})
+	if err != nil {
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+// setSpatialObject writes a spatial object's JSON payload under its spatial
+// key and updates the tag index, within an already-open transaction. opts
+// may be nil, or carry expiry options for ephemeral objects. Shared by
+// add_object_to_spatial_index, its TTL variant, and the batched
+// tx_add_spatial path so all three go through identical bookkeeping.
+func setSpatialObject(handle uint64, tx *buntdb.Tx, jsonString string, opts *buntdb.SetOptions) error {
+	var obj SpatialObject
+	fmt.Printf("Adding object: %s\n", jsonString)
+	if err := json.Unmarshal([]byte(jsonString), &obj); err != nil {
+		fmt.Printf("Error unmarshaling JSON: %v\n", err)
+		return err
+	}
+	// Create spatial key in the format that BuntDB expects
+	spatialKey := fmt.Sprintf("%s:%f:%f:%f", obj.UUID, obj.X, obj.Y, obj.Z)
+	_, _, err := tx.Set(spatialKey, jsonString, opts)
+	if err != nil {
+		fmt.Printf("Error setting object: %v\n", err)
+		return err
+	}
+	fmt.Printf("Successfully added object with UUID: %s\n", obj.UUID)
+	indexObjectTags(handle, obj.UUID, obj.Tags)
+	return nil
 }
 
 //export query_spatial_index_by_area
-func query_spatial_index_by_area(db uintptr, indexName *C.char, minX, minY, minZ, maxX, maxY, maxZ float64) *C.char {
+func query_spatial_index_by_area(handle uint64, indexName *C.char, minX, minY, minZ, maxX, maxY, maxZ float64, encoding int) C.PVBuffer {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in query_spatial_index_by_area: %v\n", err)
+		return emptyBuffer()
+	}
 	var results []string
 	fmt.Printf("Querying spatial index: %s\n", C.GoString(indexName))
 	fmt.Printf("Bounding box: [%f %f %f],[%f %f %f]\n", minX, minY, minZ, maxX, maxY, maxZ)
-	err := (*buntdb.DB)(unsafe.Pointer(db)).View(func(tx *buntdb.Tx) error {
+	err = entry.db.View(func(tx *buntdb.Tx) error {
 		return tx.Intersects(C.GoString(indexName), fmt.Sprintf("[%f %f %f],[%f %f %f]", minX, minY, minZ, maxX, maxY, maxZ), func(key, val string) bool {
 			fmt.Printf("Found intersecting object - Key: %s, Value: %s\n", key, val)
 			results = append(results, val)
@@ -162,15 +260,25 @@ func query_spatial_index_by_area(db uintptr, indexName *C.char, minX, minY, minZ
 	})
 	if err != nil {
 		fmt.Printf("Error querying spatial index: %v\n", err)
-		return C.CString("[]")
+		return emptyBuffer()
 	}
-	jsonResult, _ := json.Marshal(results)
-	fmt.Printf("Go: Spatial query result: %s\n", string(jsonResult))
-	return C.CString(string(jsonResult))
+	encoded, err := encodeObjects(results, encoding)
+	if err != nil {
+		fmt.Printf("Error encoding spatial query result: %v\n", err)
+		return emptyBuffer()
+	}
+	return makeBuffer(encoded)
 }
 
 //export index3D
 func index3D(s string) (min, max []float64) {
+	// BuntDB feeds this same function both the JSON values being indexed and
+	// the "[x y z]" / "[x y z],[x y z]" bounds strings passed to Intersects
+	// and Nearby for queries against this index. Route bracket syntax to
+	// buntdb's own rect parser instead of trying to JSON-decode it.
+	if len(s) > 0 && s[0] == '[' {
+		return buntdb.IndexRect(s)
+	}
 	var obj SpatialObject
 	if err := json.Unmarshal([]byte(s), &obj); err != nil {
 		fmt.Printf("Error unmarshaling object: %v\n", err)
@@ -181,14 +289,19 @@ func index3D(s string) (min, max []float64) {
 }
 
 //export query_object_by_uuid
-func query_object_by_uuid(db uintptr, uuid *C.char) *C.char {
+func query_object_by_uuid(handle uint64, uuid *C.char) *C.char {
 	// Retrieve an object by its UUID
 	// Parameters:
-	// - db: pointer to the BuntDB database
+	// - handle: handle to the BuntDB database
 	// - uuid: UUID of the object to retrieve
 	// Returns: JSON string of the object if found, empty string if not found
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in query_object_by_uuid: %v\n", err)
+		return C.CString("")
+	}
 	var result string
-	(*buntdb.DB)(unsafe.Pointer(db)).View(func(tx *buntdb.Tx) error {
+	entry.db.View(func(tx *buntdb.Tx) error {
 		val, err := tx.Get(C.GoString(uuid))
 		if err != nil {
 			return err
@@ -200,28 +313,48 @@ func query_object_by_uuid(db uintptr, uuid *C.char) *C.char {
 }
 
 //export delete_object_by_uuid
-func delete_object_by_uuid(db uintptr, uuid *C.char) {
+func delete_object_by_uuid(handle uint64, uuid *C.char) int {
 	// Delete an object by its UUID
 	// Parameters:
-	// - db: pointer to the BuntDB database
+	// - handle: handle to the BuntDB database
 	// - uuid: UUID of the object to delete
-	(*buntdb.DB)(unsafe.Pointer(db)).Update(func(tx *buntdb.Tx) error {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in delete_object_by_uuid: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
 		_, err := tx.Delete(C.GoString(uuid))
 		return err
 	})
+	if err != nil {
+		fmt.Printf("Error deleting object by uuid: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
 }
 
 //export update_object_by_uuid
-func update_object_by_uuid(db uintptr, uuid *C.char, jsonData *C.char) {
+func update_object_by_uuid(handle uint64, uuid *C.char, jsonData *C.char) int {
 	// Update an object by its UUID
 	// Parameters:
-	// - db: pointer to the BuntDB database
+	// - handle: handle to the BuntDB database
 	// - uuid: UUID of the object to update
 	// - jsonData: JSON string containing updated object data
-	(*buntdb.DB)(unsafe.Pointer(db)).Update(func(tx *buntdb.Tx) error {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in update_object_by_uuid: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
 		_, _, err := tx.Set(C.GoString(uuid), C.GoString(jsonData), nil)
 		return err
 	})
+	if err != nil {
+		fmt.Printf("Error updating object by uuid: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
 }
 
 /*
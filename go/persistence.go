@@ -0,0 +1,97 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"os"
+
+	"github.com/tidwall/buntdb"
+)
+
+//export create_persistent_db
+func create_persistent_db(path *C.char, syncPolicy int) uint64 {
+	db, err := buntdb.Open(C.GoString(path))
+	if err != nil {
+		// A file-backed open is far likelier to fail in production (bad
+		// path, permissions, full disk) than the in-memory case, so report
+		// failure to the caller instead of taking the whole host down.
+		fmt.Printf("Error opening persistent db: %v\n", err)
+		return 0 // registerDB never issues handle 0
+	}
+	err = db.SetConfig(buntdb.Config{
+		SyncPolicy: buntdb.SyncPolicy(syncPolicy),
+	})
+	if err != nil {
+		fmt.Printf("Error configuring sync policy: %v\n", err)
+	}
+	handle := registerDB(db)
+	loadTagBitmaps(handle)
+	return handle
+}
+
+//export shrink_db
+func shrink_db(handle uint64) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in shrink_db: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	// Flush tag bitmaps first so the AOF rewrite captures their latest state.
+	persistTagBitmaps(handle)
+	// Compact the on-disk append-only file by rewriting it with only the
+	// current dataset, dropping any stale/overwritten entries.
+	if err := entry.db.Shrink(); err != nil {
+		fmt.Printf("Error shrinking db: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+//export snapshot_db
+func snapshot_db(handle uint64, path *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in snapshot_db: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	// Write a point-in-time copy of the whole dataset to path, suitable for
+	// restoring with load_snapshot.
+	f, err := os.Create(C.GoString(path))
+	if err != nil {
+		fmt.Printf("Error creating snapshot file: %v\n", err)
+		return pvErrOperation
+	}
+	defer f.Close()
+
+	if err := entry.db.Save(f); err != nil {
+		fmt.Printf("Error saving snapshot: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+//export load_snapshot
+func load_snapshot(handle uint64, path *C.char) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in load_snapshot: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	// Replace the current dataset with the contents of a snapshot file
+	// produced by snapshot_db.
+	f, err := os.Open(C.GoString(path))
+	if err != nil {
+		fmt.Printf("Error opening snapshot file: %v\n", err)
+		return pvErrOperation
+	}
+	defer f.Close()
+
+	if err := entry.db.Load(f); err != nil {
+		fmt.Printf("Error loading snapshot: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
+}
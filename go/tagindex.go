@@ -0,0 +1,256 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// defaultSpatialIndexName is the R-tree index consulted when a tag query
+	// needs to filter candidates down to a bounding box.
+	defaultSpatialIndexName = "position"
+	tagBitmapKeyPrefix      = "__tagindex__:"
+	tagHandleTableKey       = "__tagindex_handles__"
+)
+
+// tagRegistry tracks the UUID<->handle mapping and per-tag roaring bitmaps
+// for a single database, since bitmaps can only key off compact uint32s and
+// not the UUID strings objects are stored under.
+type tagRegistry struct {
+	mu           sync.RWMutex
+	uuidToHandle map[string]uint32
+	handleToUUID map[uint32]string
+	nextHandle   uint32
+	bitmaps      map[string]*roaring.Bitmap
+	// objectTags remembers each UUID's current tag set so a re-index can
+	// diff against it and drop handles from tags the object no longer
+	// carries, instead of only ever adding.
+	objectTags map[string]map[string]bool
+}
+
+var (
+	tagRegistriesMu sync.Mutex
+	tagRegistries   = map[uint64]*tagRegistry{}
+)
+
+func getTagRegistry(handle uint64) *tagRegistry {
+	tagRegistriesMu.Lock()
+	defer tagRegistriesMu.Unlock()
+	reg, ok := tagRegistries[handle]
+	if !ok {
+		reg = &tagRegistry{
+			uuidToHandle: make(map[string]uint32),
+			handleToUUID: make(map[uint32]string),
+			bitmaps:      make(map[string]*roaring.Bitmap),
+			objectTags:   make(map[string]map[string]bool),
+		}
+		tagRegistries[handle] = reg
+	}
+	return reg
+}
+
+// removeTagRegistry drops the tag registry for handle, freeing its
+// UUID<->handle maps and per-tag bitmaps. Called from close_db so a closed
+// database's tag index doesn't outlive the database itself.
+func removeTagRegistry(handle uint64) {
+	tagRegistriesMu.Lock()
+	defer tagRegistriesMu.Unlock()
+	delete(tagRegistries, handle)
+}
+
+//export create_tag_index
+func create_tag_index(handle uint64, name *C.char) int {
+	if _, err := lookupDB(handle); err != nil {
+		fmt.Printf("Error in create_tag_index: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	// Tag bitmaps are created lazily per-tag, so this just ensures the
+	// registry exists and gives operators a log line to confirm setup.
+	getTagRegistry(handle)
+	fmt.Printf("Tag index created successfully: %s\n", C.GoString(name))
+	return pvOK
+}
+
+// indexObjectTags assigns uuid a stable handle (allocating one on first
+// sight) and adds that handle to the bitmap for every tag in tags, removing
+// it from the bitmap of any tag the object carried previously but no longer
+// does. Called from add_object_to_spatial_index whenever an object carries
+// tags, including on re-index with a different Tags slice.
+func indexObjectTags(handle uint64, uuid string, tags []string) {
+	reg := getTagRegistry(handle)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	objHandle, ok := reg.uuidToHandle[uuid]
+	if !ok {
+		objHandle = atomic.AddUint32(&reg.nextHandle, 1)
+		reg.uuidToHandle[uuid] = objHandle
+		reg.handleToUUID[objHandle] = uuid
+	}
+
+	newTags := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		newTags[tag] = true
+	}
+
+	for tag := range reg.objectTags[uuid] {
+		if newTags[tag] {
+			continue
+		}
+		if bm, ok := reg.bitmaps[tag]; ok {
+			bm.Remove(objHandle)
+		}
+	}
+
+	for tag := range newTags {
+		bm, ok := reg.bitmaps[tag]
+		if !ok {
+			bm = roaring.New()
+			reg.bitmaps[tag] = bm
+		}
+		bm.Add(objHandle)
+	}
+
+	if len(newTags) == 0 {
+		delete(reg.objectTags, uuid)
+	} else {
+		reg.objectTags[uuid] = newTags
+	}
+}
+
+//export query_by_tag_and_area
+func query_by_tag_and_area(handle uint64, tag *C.char, minX, minY, minZ, maxX, maxY, maxZ float64) *C.char {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in query_by_tag_and_area: %v\n", err)
+		return C.CString("[]")
+	}
+
+	reg := getTagRegistry(handle)
+
+	reg.mu.RLock()
+	tagBitmap, ok := reg.bitmaps[C.GoString(tag)]
+	reg.mu.RUnlock()
+	if !ok {
+		return C.CString("[]")
+	}
+
+	areaBitmap := roaring.New()
+	candidates := make(map[uint32]string)
+
+	err = entry.db.View(func(tx *buntdb.Tx) error {
+		return tx.Intersects(defaultSpatialIndexName, fmt.Sprintf("[%f %f %f],[%f %f %f]", minX, minY, minZ, maxX, maxY, maxZ), func(key, val string) bool {
+			uuid := strings.SplitN(key, ":", 2)[0]
+			reg.mu.RLock()
+			objHandle, ok := reg.uuidToHandle[uuid]
+			reg.mu.RUnlock()
+			if !ok {
+				return true
+			}
+			areaBitmap.Add(objHandle)
+			candidates[objHandle] = val
+			return true
+		})
+	})
+	if err != nil {
+		fmt.Printf("Error querying spatial index for tag query: %v\n", err)
+		return C.CString("[]")
+	}
+
+	matches := roaring.FastAnd(tagBitmap, areaBitmap)
+	var results []string
+	matches.Iterate(func(objHandle uint32) bool {
+		if val, ok := candidates[objHandle]; ok {
+			results = append(results, val)
+		}
+		return true
+	})
+
+	jsonResult, _ := json.Marshal(results)
+	return C.CString(string(jsonResult))
+}
+
+// persistTagBitmaps serializes every tag bitmap, plus the UUID<->handle
+// table they're keyed against, into the database under a dedicated key
+// namespace so they survive a restart. Called from shrink_db.
+func persistTagBitmaps(handle uint64) {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in persistTagBitmaps: %v\n", err)
+		return
+	}
+	reg := getTagRegistry(handle)
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	entry.db.Update(func(tx *buntdb.Tx) error {
+		handleTable, err := json.Marshal(reg.uuidToHandle)
+		if err != nil {
+			fmt.Printf("Error serializing tag handle table: %v\n", err)
+		} else if _, _, err := tx.Set(tagHandleTableKey, string(handleTable), nil); err != nil {
+			fmt.Printf("Error persisting tag handle table: %v\n", err)
+		}
+
+		for tag, bm := range reg.bitmaps {
+			var buf bytes.Buffer
+			if _, err := bm.WriteTo(&buf); err != nil {
+				fmt.Printf("Error serializing bitmap for tag %s: %v\n", tag, err)
+				continue
+			}
+			if _, _, err := tx.Set(tagBitmapKeyPrefix+tag, buf.String(), nil); err != nil {
+				fmt.Printf("Error persisting bitmap for tag %s: %v\n", tag, err)
+			}
+		}
+		return nil
+	})
+}
+
+// loadTagBitmaps restores tag bitmaps and the UUID<->handle table previously
+// written by persistTagBitmaps. Called after opening a database.
+func loadTagBitmaps(handle uint64) {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in loadTagBitmaps: %v\n", err)
+		return
+	}
+	reg := getTagRegistry(handle)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	entry.db.View(func(tx *buntdb.Tx) error {
+		if val, err := tx.Get(tagHandleTableKey); err == nil {
+			var handleTable map[string]uint32
+			if err := json.Unmarshal([]byte(val), &handleTable); err == nil {
+				for uuid, objHandle := range handleTable {
+					reg.uuidToHandle[uuid] = objHandle
+					reg.handleToUUID[objHandle] = uuid
+					if objHandle > reg.nextHandle {
+						reg.nextHandle = objHandle
+					}
+				}
+			}
+		}
+
+		return tx.AscendKeys(tagBitmapKeyPrefix+"*", func(key, val string) bool {
+			tag := strings.TrimPrefix(key, tagBitmapKeyPrefix)
+			bm := roaring.New()
+			if _, err := bm.ReadFrom(bytes.NewReader([]byte(val))); err != nil {
+				fmt.Printf("Error restoring bitmap for tag %s: %v\n", tag, err)
+				return true
+			}
+			reg.bitmaps[tag] = bm
+			return true
+		})
+	})
+}
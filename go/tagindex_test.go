@@ -0,0 +1,88 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"encoding/json"
+	"testing"
+	"unsafe"
+)
+
+func TestQueryByTagAndAreaFindsTaggedObjectInBounds(t *testing.T) {
+	handle := create_in_memory_db()
+	defer close_db(handle)
+
+	indexName := C.CString("position")
+	defer C.free(unsafe.Pointer(indexName))
+	if rc := create_spatial_index(handle, indexName); rc != pvOK {
+		t.Fatalf("create_spatial_index failed: %d", rc)
+	}
+
+	obj := C.CString(`{"uuid":"abc","x":1,"y":2,"z":3,"data":"enemy","tags":["enemy"]}`)
+	defer C.free(unsafe.Pointer(obj))
+	if rc := add_object_to_spatial_index(handle, obj); rc != pvOK {
+		t.Fatalf("add_object_to_spatial_index failed: %d", rc)
+	}
+
+	tag := C.CString("enemy")
+	defer C.free(unsafe.Pointer(tag))
+	result := query_by_tag_and_area(handle, tag, 0, 0, 0, 5, 5, 5)
+	defer C.free(unsafe.Pointer(result))
+
+	var matches []string
+	if err := json.Unmarshal([]byte(C.GoString(result)), &matches); err != nil {
+		t.Fatalf("invalid json result: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match for tag %q within bounds, got %d", C.GoString(tag), len(matches))
+	}
+}
+
+func TestIndexObjectTagsDropsStaleTagMembership(t *testing.T) {
+	handle := create_in_memory_db()
+	defer close_db(handle)
+
+	indexName := C.CString("position")
+	defer C.free(unsafe.Pointer(indexName))
+	if rc := create_spatial_index(handle, indexName); rc != pvOK {
+		t.Fatalf("create_spatial_index failed: %d", rc)
+	}
+
+	enemy := C.CString(`{"uuid":"abc","x":1,"y":2,"z":3,"data":"enemy","tags":["enemy"]}`)
+	defer C.free(unsafe.Pointer(enemy))
+	if rc := add_object_to_spatial_index(handle, enemy); rc != pvOK {
+		t.Fatalf("add_object_to_spatial_index failed: %d", rc)
+	}
+
+	boss := C.CString(`{"uuid":"abc","x":1,"y":2,"z":3,"data":"enemy","tags":["boss"]}`)
+	defer C.free(unsafe.Pointer(boss))
+	if rc := add_object_to_spatial_index(handle, boss); rc != pvOK {
+		t.Fatalf("add_object_to_spatial_index failed: %d", rc)
+	}
+
+	enemyTag := C.CString("enemy")
+	defer C.free(unsafe.Pointer(enemyTag))
+	stale := query_by_tag_and_area(handle, enemyTag, 0, 0, 0, 5, 5, 5)
+	defer C.free(unsafe.Pointer(stale))
+	var staleMatches []string
+	if err := json.Unmarshal([]byte(C.GoString(stale)), &staleMatches); err != nil {
+		t.Fatalf("invalid json result: %v", err)
+	}
+	if len(staleMatches) != 0 {
+		t.Fatalf("expected uuid to be dropped from its old tag's bitmap, got %d matches", len(staleMatches))
+	}
+
+	bossTag := C.CString("boss")
+	defer C.free(unsafe.Pointer(bossTag))
+	current := query_by_tag_and_area(handle, bossTag, 0, 0, 0, 5, 5, 5)
+	defer C.free(unsafe.Pointer(current))
+	var currentMatches []string
+	if err := json.Unmarshal([]byte(C.GoString(current)), &currentMatches); err != nil {
+		t.Fatalf("invalid json result: %v", err)
+	}
+	if len(currentMatches) != 1 {
+		t.Fatalf("expected 1 match for the object's current tag, got %d", len(currentMatches))
+	}
+}
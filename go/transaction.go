@@ -0,0 +1,186 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// txIdleTimeout bounds how long a batched transaction may sit open without a
+// command. BuntDB serializes all writers behind a single lock, so a caller
+// that opens a writable tx and never commits/rolls back (crash, dropped
+// reference, embedder bug) would otherwise freeze every write on the handle
+// forever; timing out and rolling back caps the damage to one bad tx.
+const txIdleTimeout = 30 * time.Second
+
+type txOp int
+
+const (
+	txOpSet txOp = iota
+	txOpDelete
+	txOpAddSpatial
+	txOpCommit
+	txOpRollback
+)
+
+type txCommand struct {
+	op    txOp
+	key   string
+	val   string
+	reply chan error
+}
+
+// txState owns one in-flight BuntDB transaction. BuntDB transactions must be
+// driven from the goroutine that opened them, so cgo entry points marshal
+// each operation onto cmds and block on the per-command reply channel for
+// an ack, letting a caller stream many writes into one atomic commit.
+type txState struct {
+	cmds chan txCommand
+	// done is closed once the driving goroutine has stopped reading from
+	// cmds (idle timeout, commit, or rollback), so a sendTxCommand racing
+	// the end of the transaction can bail out of the cmds send instead of
+	// blocking on it forever.
+	done chan struct{}
+}
+
+var (
+	txRegistry   sync.Map // map[uintptr]*txState
+	txHandleNext uint64
+)
+
+var (
+	errTxRollback = errors.New("transaction rolled back")
+	errTxTimedOut = errors.New("transaction timed out and was rolled back")
+)
+
+//export begin_tx
+func begin_tx(handle uint64, writable int) uintptr {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in begin_tx: %v\n", err)
+		return 0
+	}
+
+	cmds := make(chan txCommand)
+	done := make(chan struct{})
+	txHandle := uintptr(atomic.AddUint64(&txHandleNext, 1))
+	txRegistry.Store(txHandle, &txState{cmds: cmds, done: done})
+
+	go func() {
+		var finalReply chan error
+		fn := func(tx *buntdb.Tx) error {
+			timer := time.NewTimer(txIdleTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case cmd := <-cmds:
+					if !timer.Stop() {
+						<-timer.C
+					}
+					switch cmd.op {
+					case txOpSet:
+						_, _, err := tx.Set(cmd.key, cmd.val, nil)
+						cmd.reply <- err
+					case txOpDelete:
+						_, err := tx.Delete(cmd.key)
+						cmd.reply <- err
+					case txOpAddSpatial:
+						cmd.reply <- setSpatialObject(handle, tx, cmd.val, nil)
+					case txOpCommit:
+						finalReply = cmd.reply
+						return nil
+					case txOpRollback:
+						finalReply = cmd.reply
+						return errTxRollback
+					}
+					timer.Reset(txIdleTimeout)
+				case <-timer.C:
+					fmt.Printf("Transaction %d idle for %s with no commit/rollback; forcing rollback\n", txHandle, txIdleTimeout)
+					return errTxTimedOut
+				}
+			}
+		}
+
+		var err error
+		if writable != 0 {
+			err = entry.db.Update(fn)
+		} else {
+			err = entry.db.View(fn)
+		}
+		// Signal sendTxCommand callers racing this return that nobody will
+		// ever read cmds again, before the handle is forgotten, so a
+		// blocked send fails fast instead of leaking a goroutine.
+		close(done)
+		txRegistry.Delete(txHandle)
+
+		if err == errTxRollback || err == errTxTimedOut {
+			err = nil
+		}
+		if finalReply != nil {
+			finalReply <- err
+		}
+	}()
+
+	return txHandle
+}
+
+// sendTxCommand marshals cmd onto the goroutine driving tx and waits for its
+// ack, returning an error if the handle is unknown or the op itself failed.
+func sendTxCommand(tx uintptr, cmd txCommand) error {
+	v, ok := txRegistry.Load(tx)
+	if !ok {
+		return fmt.Errorf("unknown transaction handle: %d", tx)
+	}
+	state := v.(*txState)
+	cmd.reply = make(chan error, 1)
+	select {
+	case state.cmds <- cmd:
+	case <-state.done:
+		return fmt.Errorf("transaction handle %d is no longer active", tx)
+	}
+	return <-cmd.reply
+}
+
+//export tx_set
+func tx_set(tx uintptr, key, val *C.char) {
+	if err := sendTxCommand(tx, txCommand{op: txOpSet, key: C.GoString(key), val: C.GoString(val)}); err != nil {
+		fmt.Printf("Error in tx_set: %v\n", err)
+	}
+}
+
+//export tx_delete
+func tx_delete(tx uintptr, key *C.char) {
+	if err := sendTxCommand(tx, txCommand{op: txOpDelete, key: C.GoString(key)}); err != nil {
+		fmt.Printf("Error in tx_delete: %v\n", err)
+	}
+}
+
+//export tx_add_spatial
+func tx_add_spatial(tx uintptr, jsonData *C.char) {
+	if err := sendTxCommand(tx, txCommand{op: txOpAddSpatial, val: C.GoString(jsonData)}); err != nil {
+		fmt.Printf("Error in tx_add_spatial: %v\n", err)
+	}
+}
+
+//export commit_tx
+func commit_tx(tx uintptr) *C.char {
+	if err := sendTxCommand(tx, txCommand{op: txOpCommit}); err != nil {
+		return C.CString(err.Error())
+	}
+	return C.CString("")
+}
+
+//export rollback_tx
+func rollback_tx(tx uintptr) {
+	if err := sendTxCommand(tx, txCommand{op: txOpRollback}); err != nil {
+		fmt.Printf("Error rolling back transaction: %v\n", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+//export add_object_to_spatial_index_ttl
+func add_object_to_spatial_index_ttl(handle uint64, jsonData *C.char, ttlSeconds float64) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in add_object_to_spatial_index_ttl: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	opts := &buntdb.SetOptions{Expires: true, TTL: secondsToDuration(ttlSeconds)}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
+		return setSpatialObject(handle, tx, C.GoString(jsonData), opts)
+	})
+	if err != nil {
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+//export set_object_ttl
+func set_object_ttl(handle uint64, key *C.char, value *C.char, ttlSeconds float64) int {
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in set_object_ttl: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	opts := &buntdb.SetOptions{Expires: true, TTL: secondsToDuration(ttlSeconds)}
+	err = entry.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(C.GoString(key), C.GoString(value), opts)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error setting object ttl: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+//export set_config
+func set_config(handle uint64, autoShrinkPercentage int, autoShrinkMinSize int) int {
+	// Lets callers tune AOF growth caused by high-churn ephemeral objects,
+	// since expiring a lot of short-lived entities (projectiles, loot drops,
+	// damage numbers) otherwise leaves the file growing unbounded between
+	// manual shrink_db calls.
+	entry, err := lookupDB(handle)
+	if err != nil {
+		fmt.Printf("Error in set_config: %v\n", err)
+		return pvErrInvalidHandle
+	}
+	var cfg buntdb.Config
+	if err := entry.db.ReadConfig(&cfg); err != nil {
+		fmt.Printf("Error reading db config: %v\n", err)
+		return pvErrOperation
+	}
+	cfg.AutoShrinkPercentage = autoShrinkPercentage
+	cfg.AutoShrinkMinSize = autoShrinkMinSize
+	if err := entry.db.SetConfig(cfg); err != nil {
+		fmt.Printf("Error applying db config: %v\n", err)
+		return pvErrOperation
+	}
+	return pvOK
+}
+
+func secondsToDuration(ttlSeconds float64) time.Duration {
+	return time.Duration(ttlSeconds * float64(time.Second))
+}